@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nats-io/nats.go"
+
+	"github.com/netlify/messaging"
+)
+
+// App wires together every long-lived component the service needs: logging,
+// metrics, the NATS connection, the configured Output, the optional WAL, and
+// the processor chain. Building it all in one place means nothing reaches
+// for a package-level global, and Run can tear every piece down cleanly on
+// shutdown.
+type App struct {
+	config *configuration
+
+	log     *logrus.Entry
+	nats    *nats.Conn
+	out     Output
+	wal     *WAL
+	metrics *Metrics
+	chain   []Processor
+}
+
+// newApp builds every component described by config but does not yet
+// subscribe to any subjects or start consuming; that happens in Run.
+func newApp(config *configuration) (*App, error) {
+	log, err := configureLogging(&config.LogConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure logging: %v", err)
+	}
+
+	metrics := NewMetrics()
+
+	out, err := buildOutput(&config.OutputConf, metrics, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build output: %v", err)
+	}
+
+	chain, err := buildProcessorChain(config.Processors)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build processor chain: %v", err)
+	}
+
+	var wal *WAL
+	if config.WALConf.Enabled {
+		wal, err = newWAL(&config.WALConf, log)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open wal: %v", err)
+		}
+	}
+
+	log.WithFields(config.NatsConf.LogFields()).Info("Connecting to Nats")
+	nc, err := messaging.ConnectToNats(&config.NatsConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %v", err)
+	}
+
+	a := &App{
+		config:  config,
+		log:     log,
+		nats:    nc,
+		out:     out,
+		wal:     wal,
+		metrics: metrics,
+		chain:   chain,
+	}
+
+	a.metrics.SetNatsConnected(true)
+	nc.SetDisconnectErrHandler(func(_ *nats.Conn, _ error) { a.metrics.SetNatsConnected(false) })
+	nc.SetReconnectHandler(func(_ *nats.Conn) { a.metrics.SetNatsConnected(true) })
+
+	return a, nil
+}
+
+// Run subscribes to every configured subject and blocks until ctx is
+// cancelled, at which point it drains in-flight work and shuts every
+// component down cleanly rather than dropping it on the floor.
+func (a *App) Run(ctx context.Context) error {
+	go func() {
+		if err := a.metrics.Serve(a.config.MetricsConf.Addr, a.log); err != nil {
+			a.log.WithError(err).Warn("Metrics server stopped")
+		}
+	}()
+
+	clientChannel := make(chan *payload)
+
+	var batchWG sync.WaitGroup
+	batchWG.Add(1)
+	go func() {
+		defer batchWG.Done()
+		a.batchAndSend(clientChannel)
+	}()
+
+	if a.wal != nil {
+		a.log.Info("Replaying wal from last committed watermark")
+		if err := a.wal.Replay(func(p *payload) error {
+			clientChannel <- p
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to replay wal: %v", err)
+		}
+	}
+
+	var consumerWG sync.WaitGroup
+	var msgWG sync.WaitGroup
+	for _, pair := range a.config.Subjects {
+		pair := pair
+		log := a.log.WithFields(logrus.Fields{
+			"subject": pair.Subject,
+			"group":   pair.Group,
+		})
+
+		consumerWG.Add(1)
+		if a.config.JetStreamConf.Enabled && pair.Durable != "" {
+			js, err := a.nats.JetStream()
+			if err != nil {
+				return fmt.Errorf("failed to get jetstream context: %v", err)
+			}
+
+			sub, err := js.PullSubscribe(pair.Subject, pair.Durable)
+			if err != nil {
+				return fmt.Errorf("failed to create durable pull subscription for '%s': %v", pair.Subject, err)
+			}
+
+			go func() {
+				defer consumerWG.Done()
+				log.Info("Starting to consume via jetstream")
+				if err := a.consumeJetStream(ctx, sub, clientChannel, &a.config.JetStreamConf); err != nil {
+					log.WithError(err).Warn("Problem while consuming messages")
+				}
+				log.Info("Finished consuming")
+			}()
+			continue
+		}
+
+		var sub *nats.Subscription
+		var err error
+		if pair.Group == "" {
+			sub, err = a.nats.SubscribeSync(pair.Subject)
+		} else {
+			sub, err = a.nats.QueueSubscribeSync(pair.Subject, pair.Group)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to '%s': %v", pair.Subject, err)
+		}
+
+		go func() {
+			defer consumerWG.Done()
+			log.Info("Starting to consume")
+			if err := a.consumeForever(ctx, sub, clientChannel, &msgWG); err != nil {
+				log.WithError(err).Warn("Problem while consuming messages")
+			}
+			log.Info("Finished consuming")
+		}()
+	}
+
+	<-ctx.Done()
+	a.log.Info("Shutting down")
+
+	// Wait for every subscription loop and every per-message goroutine it
+	// spawned to finish before closing clientChannel -- otherwise a message
+	// still in flight could block forever trying to send on a channel
+	// nothing is reading anymore, or get dropped with batchAndSend already
+	// gone.
+	consumerWG.Wait()
+	msgWG.Wait()
+	close(clientChannel)
+	batchWG.Wait()
+
+	return a.Close()
+}
+
+// Close flushes and closes every component in turn. Run calls it on its way
+// out of a graceful shutdown; when Run returns an error before that point,
+// Close has not been called. It is not safe to call more than once.
+func (a *App) Close() error {
+	if err := a.out.Close(); err != nil {
+		a.log.WithError(err).Warn("Failed to close output cleanly")
+	}
+
+	if a.wal != nil {
+		if err := a.wal.Close(); err != nil {
+			a.log.WithError(err).Warn("Failed to close wal cleanly")
+		}
+	}
+
+	a.nats.Close()
+
+	return nil
+}
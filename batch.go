@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// batchAndSend groups incoming payloads and hands each batch, in the order it
+// was formed, to a single committer goroutine that sends it to the Output
+// and, on success, advances the wal watermark. Committing strictly in order
+// -- never concurrently -- matters because wal.Commit only knows "reqNum",
+// not "every lower reqNum is also accounted for": if two batches were sent
+// concurrently and the one with higher reqNums happened to finish first, its
+// commit would advance the watermark past an earlier batch that was still in
+// flight or had failed, and Replay would skip those records forever on the
+// next crash. batchAndSend itself keeps consuming until incoming is closed
+// rather than exiting as soon as ctx is cancelled -- the caller only closes
+// it once every goroutine that could still write to it has finished, so a
+// message already in flight when shutdown started is handed off and sent
+// instead of silently dropped.
+func (a *App) batchAndSend(incoming <-chan *payload) {
+	config := &a.config.BatchConf
+	log := a.log.WithFields(logrus.Fields{
+		"batch_size":    config.BatchSize,
+		"batch_timeout": config.BatchTimeoutSec,
+	})
+	log.Info("Starting to consume forever and batch send")
+
+	toCommit := make(chan []*payload)
+	var committerWG sync.WaitGroup
+	committerWG.Add(1)
+	go func() {
+		defer committerWG.Done()
+		// Once a batch has failed, the watermark is held where it is for the
+		// rest of the run, so a later successful batch can't commit past the
+		// failed one's records and they are still replayed on the next start.
+		walHeld := false
+		for batch := range toCommit {
+			if !a.sendBatch(context.Background(), log, batch, !walHeld) {
+				walHeld = true
+			}
+		}
+	}()
+	defer committerWG.Wait()
+	defer close(toCommit)
+
+	batch := make([]*payload, 0, config.BatchSize)
+
+	for {
+		select {
+		case in, ok := <-incoming:
+			if !ok {
+				log.Info("Flushing final batch before shutdown")
+				toCommit <- batch
+				return
+			}
+			batch = append(batch, in)
+			if len(batch) >= config.BatchSize {
+				log.Debug("Sending batch because it hit the right size")
+				toCommit <- batch
+				batch = make([]*payload, 0, config.BatchSize)
+			}
+		case <-time.After(time.Duration(config.BatchTimeoutSec) * time.Second):
+			log.Debug("Sending batch because of timeout")
+			toCommit <- batch
+			batch = make([]*payload, 0, config.BatchSize)
+		}
+	}
+}
+
+// sendBatch sends batch to the Output, acks or naks its messages, and, if
+// commitWAL is set, advances the wal watermark on success. It reports whether
+// the send succeeded.
+func (a *App) sendBatch(ctx context.Context, log *logrus.Entry, batch []*payload, commitWAL bool) bool {
+	if len(batch) == 0 {
+		return true
+	}
+
+	log = log.WithField("size", len(batch))
+	log.Debug("Sending batch to output")
+
+	start := time.Now()
+	err := a.out.Send(ctx, batch)
+	a.metrics.ObserveBatch(len(batch), time.Since(start))
+
+	// Send only returns once the Output has confirmed the batch one way or
+	// the other, so ack/nak and the wal watermark can both be driven off its
+	// return value here, the same way for every Output implementation.
+	if err != nil {
+		log.WithError(err).Warn("Failed to send batch to output")
+		for _, p := range batch {
+			if nakErr := p.Nak(); nakErr != nil {
+				log.WithError(nakErr).Warn("Failed to nak message after failed send")
+			}
+		}
+		return false
+	}
+
+	for _, p := range batch {
+		if ackErr := p.Ack(); ackErr != nil {
+			log.WithError(ackErr).Warn("Failed to ack message after send")
+		}
+	}
+
+	if a.wal != nil && commitWAL {
+		if err := a.wal.Commit(highestWALSeq(batch)); err != nil {
+			log.WithError(err).Warn("Failed to advance wal watermark")
+		}
+	}
+
+	log.Debug("Sent")
+	return true
+}
+
+func highestWALSeq(batch []*payload) uint64 {
+	var max uint64
+	for _, p := range batch {
+		if p.walSeq > max {
+			max = p.walSeq
+		}
+	}
+	return max
+}
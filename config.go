@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/netlify/messaging"
+)
+
+type logConf struct {
+	Level string `json:"level"`
+}
+
+type subjectConf struct {
+	Subject string `json:"subject"`
+	Group   string `json:"group"`
+
+	// Durable, if set while jetstream_conf.enabled is true, subscribes
+	// through JetStream as a durable pull consumer instead of a
+	// fire-and-forget core NATS subscription. With JetStream disabled it is
+	// ignored.
+	Durable string `json:"durable"`
+}
+
+type batchConfig struct {
+	BatchSize       int `json:"batch_size"`
+	BatchTimeoutSec int `json:"batch_timeout_sec"`
+}
+
+type jetStreamConfig struct {
+	Enabled    bool `json:"enabled"`
+	FetchBatch int  `json:"fetch_batch"`
+	MaxWaitMS  int  `json:"max_wait_ms"`
+}
+
+type configuration struct {
+	LogConf       logConf              `json:"log_conf"`
+	NatsConf      messaging.NatsConfig `json:"nats_conf"`
+	JetStreamConf jetStreamConfig      `json:"jetstream_conf"`
+	BatchConf     batchConfig          `json:"batch_conf"`
+	OutputConf    outputConfig         `json:"output_conf"`
+	MetricsConf   metricsConfig        `json:"metrics_conf"`
+	WALConf       walConfig            `json:"wal"`
+	Processors    []processorConfig    `json:"processors"`
+	Subjects      []subjectConf        `json:"subjects"`
+}
+
+func loadFromFile(path string, config *configuration) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(config); err != nil {
+		return fmt.Errorf("failed to decode config file: %v", err)
+	}
+
+	return nil
+}
+
+func configureLogging(config *logConf) (*logrus.Entry, error) {
+	log := logrus.New()
+
+	if config.Level != "" {
+		level, err := logrus.ParseLevel(config.Level)
+		if err != nil {
+			return nil, fmt.Errorf("unknown log level '%s': %v", config.Level, err)
+		}
+		log.Level = level
+	}
+
+	return logrus.NewEntry(log), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// consumeForever reads core NATS messages until ctx is cancelled or the
+// subscription errors out. Messages are fire-and-forget: if the process dies
+// between receipt and a successful send, the message is lost, which is why
+// consumeJetStream exists for subjects that need at-least-once delivery.
+// Every per-message goroutine it spawns is tracked on wg so the caller can
+// wait for them to finish handing their payload off before it closes the
+// channel they're sending on.
+func (a *App) consumeForever(ctx context.Context, sub *nats.Subscription, toSend chan<- *payload, wg *sync.WaitGroup) error {
+	for {
+		m, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nats.ErrTimeout {
+				return err
+			}
+			continue
+		}
+
+		// DO NOT BLOCK
+		// nats is truely a fire and forget, we need to get make sure we are ready to
+		// take off the subject immediately. And we can have tons of go routines so
+		// this seems like the natural pairing.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			a.metrics.NatsMessageReceived(m.Subject)
+
+			payload := newPayload(string(m.Data), m.Subject)
+
+			// maybe it is json!
+			_ = json.Unmarshal(m.Data, payload)
+
+			payload, err := runProcessors(a.chain, payload)
+			if err != nil {
+				a.log.WithError(err).Warn("Processor chain failed, dropping payload")
+				return
+			}
+			if payload == nil {
+				return
+			}
+
+			if err := appendToWAL(a.wal, payload); err != nil {
+				a.log.WithError(err).Warn("Failed to append to wal, dropping payload")
+				return
+			}
+
+			toSend <- payload
+		}()
+	}
+}
+
+// consumeJetStream pulls messages from a durable JetStream consumer and
+// hands them off on toSend. Unlike consumeForever, delivery is at-least-once:
+// the message is only acked once an Output has confirmed it was persisted
+// (see payload.Ack), so a crash between receipt and persistence just results
+// in redelivery instead of data loss.
+func (a *App) consumeJetStream(ctx context.Context, sub *nats.Subscription, toSend chan<- *payload, config *jetStreamConfig) error {
+	fetchBatch := config.FetchBatch
+	if fetchBatch <= 0 {
+		fetchBatch = 1
+	}
+
+	maxWait := time.Duration(config.MaxWaitMS) * time.Millisecond
+	if maxWait <= 0 {
+		maxWait = 5 * time.Second
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		msgs, err := sub.Fetch(fetchBatch, nats.MaxWait(maxWait))
+		if err != nil {
+			if err == nats.ErrTimeout {
+				continue
+			}
+			return err
+		}
+
+		for _, m := range msgs {
+			a.metrics.NatsMessageReceived(m.Subject)
+
+			p := newPayload(string(m.Data), m.Subject)
+			p.msg = m
+
+			// maybe it is json!
+			_ = json.Unmarshal(m.Data, p)
+
+			p, err := runProcessors(a.chain, p)
+			if err != nil {
+				a.log.WithError(err).Warn("Processor chain failed, nacking message")
+				if nakErr := m.Nak(); nakErr != nil {
+					a.log.WithError(nakErr).Warn("Failed to nak message after processor error")
+				}
+				continue
+			}
+			if p == nil {
+				// intentionally dropped (e.g. drop_if_match) -- nothing more to persist
+				if ackErr := m.Ack(); ackErr != nil {
+					a.log.WithError(ackErr).Warn("Failed to ack dropped message")
+				}
+				continue
+			}
+
+			if err := appendToWAL(a.wal, p); err != nil {
+				a.log.WithError(err).Warn("Failed to append to wal, nacking message")
+				if nakErr := m.Nak(); nakErr != nil {
+					a.log.WithError(nakErr).Warn("Failed to nak message after wal append error")
+				}
+				continue
+			}
+
+			toSend <- p
+		}
+	}
+}
@@ -1,172 +1,181 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/mattbaird/elastigo/lib"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
 )
 
-const (
-	rawMsgKey    = "@raw_msg"
-	timestampKey = "@timestamp"
-	sourceKey    = "@source"
-)
-
-type payload map[string]interface{}
-
-func newPayload(msg, source string) *payload {
-	return &payload{
-		rawMsgKey:    msg,
-		sourceKey:    source,
-		timestampKey: time.Now().Format(time.RFC3339),
-	}
+type elasticConfig struct {
+	Index           string   `json:"index"`
+	Hosts           []string `json:"hosts"`
+	Trace           bool     `json:"trace"`
+	NumWorkers      int      `json:"num_workers"`
+	FlushBytes      int      `json:"flush_bytes"`
+	FlushIntervalMS int      `json:"flush_interval_ms"`
+	MaxRetries      int      `json:"max_retries"`
 }
 
-type elasticConfig struct {
-	Index             string   `json:"index"`
-	Hosts             []string `json:"hosts"`
-	Port              int      `json:"port"`
-	Trace             bool     `json:"trace"`
-	ReconnectAttempts int      `json:"reconnect_attempts"`
-	RetrySeconds      int      `json:"retry_seconds"`
-	BatchSize         int      `json:"batch_size"`
-	BatchTimeoutSec   int      `json:"batch_timeout_sec"`
+// esOutput sends batches to Elasticsearch through a single long-lived
+// esutil.BulkIndexer, retrying transient failures with an exponential
+// backoff instead of reconnecting per batch.
+type esOutput struct {
+	indexer    esutil.BulkIndexer
+	index      string
+	maxRetries int
+	log        *logrus.Entry
+	metrics    *Metrics
 }
 
-func (config elasticConfig) connectToES(log *logrus.Entry) (*elastigo.Conn, error) {
-	log.WithFields(logrus.Fields{
+func newESOutput(config *elasticConfig, metrics *Metrics, log *logrus.Entry) (*esOutput, error) {
+	log = log.WithFields(logrus.Fields{
 		"hosts": config.Hosts,
 		"index": config.Index,
-		"port":  config.Port,
-		"trace": config.Trace,
-	}).Info("Connecting to elastic search")
+	})
+	log.Info("Connecting to elasticsearch")
 
-	conn := elastigo.NewConn()
-	if config.Port > 0 {
-		conn.SetPort(fmt.Sprintf("%d", config.Port))
+	esConfig := elasticsearch.Config{
+		Addresses: config.Hosts,
 	}
-
 	if config.Trace {
-		conn.RequestTracer = func(method, url, body string) {
-			log.WithFields(logrus.Fields{
-				"component": "es",
-				"method":    method,
-				"url":       url,
-				"trace":     true,
-			}).Info(body)
-		}
+		esConfig.EnableDebugLogger = true
 	}
-	conn.Hosts = config.Hosts
-	return conn, nil
-}
 
-func batchAndSend(config *elasticConfig, incoming <-chan *payload, stats *counters, log *logrus.Entry) {
-	log = log.WithFields(logrus.Fields{
-		"index": config.Index,
-		"hosts": config.Hosts,
-		"port":  config.Port,
-	})
+	client, err := elasticsearch.NewClient(esConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build elasticsearch client: %v", err)
+	}
 
-	log.WithFields(logrus.Fields{
-		"batch_size":    config.BatchSize,
-		"batch_timeout": config.BatchTimeoutSec,
-	}).Info("Starting to consume forever and batch send to ES")
-
-	batch := make([]*payload, 0, config.BatchSize)
-
-	for {
-		select {
-		case in := <-incoming:
-			batch = append(batch, in)
-			if len(batch) >= config.BatchSize {
-				log.Debug("Sending batch it sent the right size")
-				go sendToES(config, log, stats, batch)
-				batch = make([]*payload, 0, config.BatchSize)
-			}
-		case <-time.After(time.Duration(config.BatchTimeoutSec) * time.Second):
-			log.Debug("Sending batch because of timeout")
-			go sendToES(config, log, stats, batch)
-			batch = make([]*payload, 0, config.BatchSize)
-		}
+	flushInterval := time.Duration(config.FlushIntervalMS) * time.Millisecond
+	if flushInterval == 0 {
+		flushInterval = 30 * time.Second
+	}
+
+	indexer, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Index:         config.Index,
+		Client:        client,
+		NumWorkers:    config.NumWorkers,
+		FlushBytes:    config.FlushBytes,
+		FlushInterval: flushInterval,
+		OnError: func(_ context.Context, err error) {
+			log.WithError(err).Warn("Bulk indexer error")
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build bulk indexer: %v", err)
 	}
+
+	return &esOutput{
+		indexer:    indexer,
+		index:      config.Index,
+		maxRetries: config.MaxRetries,
+		log:        log,
+		metrics:    metrics,
+	}, nil
 }
 
-func sendToES(config *elasticConfig, log *logrus.Entry, stats *counters, batch []*payload) {
+// Send hands every item in batch to the bulk indexer and blocks until each
+// one has actually been flushed to Elasticsearch and its OnSuccess/OnFailure
+// callback has fired. That's what lets the caller treat a nil return as "this
+// batch is durably persisted" rather than merely "this batch was enqueued" --
+// the wal watermark and JetStream acking both depend on that guarantee.
+func (o *esOutput) Send(ctx context.Context, batch []*payload) error {
 	if len(batch) == 0 {
-		return
+		return nil
 	}
 
-	log = log.WithFields(logrus.Fields{
-		"size":     len(batch),
-		"batch_id": rand.Int(),
-	})
+	var wg sync.WaitGroup
+	var failed int32
 
-	client, err := config.connectToES(log)
-	if err != nil {
-		log.WithError(err).Fatal("Failed to connect to elasticsearch")
-	}
-	log.Debug("Connected to elasticseach")
-	indexer := client.NewBulkIndexerErrors(3, config.RetrySeconds)
-	go logErrors(indexer, log)
-
-	log.Debug("Started indexer")
-	indexer.Start()
-	defer func() {
-		log.Debug("Shutting down indexer")
-		indexer.Flush()
-		indexer.Stop()
-	}()
-
-	for _, in := range batch {
-		payload := *in
-		resend := true
-		for resend {
-			resend = false
-			log.Debugf("Sending to ES: %s", payload)
-
-			now := time.Now()
-			err := indexer.Index(
-				config.Index, // index
-				"log_line",   // _type
-				"",           // _id
-				"",           // parent
-				"",           // ttl
-				&now,         // _timestamp
-				payload,
-			)
-			if err != nil {
-				log.WithError(err).Warn("Error sending data to elasticsearch -- retrying")
-				client = reconnect(log, config)
-				resend = true
-			} else {
-				log.Debug("Sent")
-				stats.esSent++
-			}
+	wg.Add(len(batch))
+
+	for _, p := range batch {
+		p := p // local copy so the per-item callbacks below close over the right payload
+
+		index := o.index
+		if override, ok := p.indexOverride(); ok {
+			index = override
+		}
+
+		raw, err := json.Marshal(p)
+		if err != nil {
+			o.log.WithError(err).Warn("Failed to marshal payload, dropping it")
+			atomic.AddInt32(&failed, 1)
+			wg.Done()
+			continue
+		}
+
+		item := esutil.BulkIndexerItem{
+			Index:  index,
+			Action: "index",
+			Body:   bytes.NewReader(raw),
+			OnSuccess: func(_ context.Context, _ esutil.BulkIndexerItem, _ esutil.BulkIndexerResponseItem) {
+				defer wg.Done()
+				o.metrics.ESDocumentIndexed(index, "success")
+			},
+			OnFailure: func(_ context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+				defer wg.Done()
+				o.metrics.ESDocumentIndexed(index, "failure")
+				atomic.AddInt32(&failed, 1)
+				if err != nil {
+					o.log.WithError(err).Warn("Failed to index document")
+				} else {
+					o.log.WithField("error", res.Error).Warn("Failed to index document")
+				}
+			},
 		}
-	}
-}
 
-func reconnect(log *logrus.Entry, config *elasticConfig) *elastigo.Conn {
-	times := 0
-	for ; times < config.ReconnectAttempts; times++ {
-		log.Debugf("reconnecting attempt %d/%d", times+1, config.ReconnectAttempts)
-		client, err := config.connectToES(log)
-		if err == nil {
-			log.Infof("Reconnected after %d attempts", times+1)
-			return client
+		if err := o.addWithBackoff(ctx, p, item); err != nil {
+			atomic.AddInt32(&failed, 1)
+			wg.Done()
+			continue
 		}
+	}
+
+	wg.Wait()
 
-		log.WithError(err).Warn("Failed to reconnect attempt %d", times+1)
+	if failed > 0 {
+		return fmt.Errorf("failed to index %d of %d documents", failed, len(batch))
 	}
-	log.Fatalf("Failed to reconnect to elasticsearch after %d attempts", config.ReconnectAttempts)
 	return nil
 }
 
-func logErrors(indexer *elastigo.BulkIndexer, log *logrus.Entry) {
-	for errBuf := range indexer.ErrorChannel {
-		log.WithError(errBuf.Err).Warn("Trouble sending message to ES")
+// addWithBackoff retries handing the item to the bulk indexer's internal
+// queue, in case it's momentarily full, rather than blocking forever. Each
+// retry heartbeats the originating JetStream message so it isn't redelivered
+// out from under a slow indexer. When maxRetries is set it gives up after
+// that many retries; otherwise it stops when the exponential backoff's own
+// elapsed-time limit runs out. Either way a persistently full indexer
+// eventually naks the message instead of wedging this goroutine indefinitely.
+func (o *esOutput) addWithBackoff(ctx context.Context, p *payload, item esutil.BulkIndexerItem) error {
+	bo := backoff.WithContext(backoff.NewExponentialBackOff(), ctx)
+	var limited backoff.BackOff = bo
+	if o.maxRetries > 0 {
+		limited = backoff.WithMaxRetries(bo, uint64(o.maxRetries))
 	}
-}
\ No newline at end of file
+
+	first := true
+	return backoff.Retry(func() error {
+		if !first {
+			o.metrics.BulkIndexerRetried()
+			if err := p.InProgress(); err != nil {
+				o.log.WithError(err).Warn("Failed to heartbeat in-progress message")
+			}
+		}
+		first = false
+		return o.indexer.Add(ctx, item)
+	}, limited)
+}
+
+func (o *esOutput) Close() error {
+	return o.indexer.Close(context.Background())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Shopify/sarama"
+)
+
+type kafkaConfig struct {
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+}
+
+// kafkaOutput fans payloads out to a Kafka topic instead of Elasticsearch,
+// useful for shipping the same stream to a downstream consumer.
+type kafkaOutput struct {
+	producer sarama.SyncProducer
+	topic    string
+	log      *logrus.Entry
+}
+
+func newKafkaOutput(config *kafkaConfig, log *logrus.Entry) (*kafkaOutput, error) {
+	if config.Topic == "" {
+		return nil, fmt.Errorf("kafka output requires a topic")
+	}
+
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(config.Brokers, saramaConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to kafka: %v", err)
+	}
+
+	return &kafkaOutput{producer: producer, topic: config.Topic, log: log}, nil
+}
+
+func (o *kafkaOutput) Send(_ context.Context, batch []*payload) error {
+	for _, p := range batch {
+		raw, err := json.Marshal(p)
+		if err != nil {
+			o.log.WithError(err).Warn("Failed to marshal payload for kafka")
+			return err
+		}
+
+		msg := &sarama.ProducerMessage{
+			Topic: o.topic,
+			Value: sarama.ByteEncoder(raw),
+		}
+		if _, _, err := o.producer.SendMessage(msg); err != nil {
+			o.log.WithError(err).Warn("Failed to send payload to kafka")
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *kafkaOutput) Close() error {
+	return o.producer.Close()
+}
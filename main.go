@@ -1,26 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"log"
 	"os"
-	"sync"
-	"time"
+	"os/signal"
+	"syscall"
 
-	"github.com/Sirupsen/logrus"
-	"github.com/nats-io/nats"
 	"github.com/spf13/cobra"
-
-	"github.com/netlify/messaging"
 )
 
-var rootLog *logrus.Entry
-
-type counters struct {
-	natsConsumed int64
-	esSent       int64
-}
-
 func main() {
 	var cfgFile string
 	rootCmd := cobra.Command{
@@ -34,120 +23,37 @@ func main() {
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "config.json", "the json config file")
 
 	if err := rootCmd.Execute(); err != nil {
-		if rootLog != nil {
-			rootLog.WithError(err).Warn("Failed to execute command")
-		}
+		log.Printf("Failed to execute command: %v", err)
 		os.Exit(1)
 	}
 }
 
 func run(configFile string) {
 	config := new(configuration)
-	err := loadFromFile(configFile, config)
-	if err != nil {
+	if err := loadFromFile(configFile, config); err != nil {
 		log.Fatalf("Failed to load configuation: %s %v", configFile, err)
 	}
 
-	rootLog, err = configureLogging(&config.LogConf)
+	app, err := newApp(config)
 	if err != nil {
-		log.Fatalf("Failed to configure logging")
-	}
-
-	rootLog.Info("Configured - starting to connect and consume")
-
-	// connect to ES
-	clientChannel := make(chan *payload)
-	stats := new(counters)
-	go reportStats(config.ReportSec, stats, rootLog)
-
-	go batchAndSend(&config.ElasticConf, clientChannel, stats, rootLog)
-
-	// connect to NATS
-	rootLog.WithFields(config.NatsConf.LogFields()).Info("Connecting to Nats")
-	nc, err := messaging.ConnectToNats(&config.NatsConf)
-	if err != nil {
-		rootLog.WithError(err).Fatal("Failed to connect to nats")
-	}
-
-	// build all the tailers
-	wg := sync.WaitGroup{}
-	funcs := make([]func(), 0, len(config.Subjects))
-	for _, pair := range config.Subjects {
-		log := rootLog.WithFields(logrus.Fields{
-			"subject": pair.Subject,
-			"group":   pair.Group,
-		})
-		log.Debug("Connecting channel")
-
-		var err error
-		var sub *nats.Subscription
-		if pair.Group == "" {
-			sub, err = nc.Subscribe(pair.Subject, processMsg)
-		} else {
-			sub, err = nc.QueueSubscribe(pair.Subject, pair.Group, processMsg)
-		}
-		if err != nil {
-			log.WithError(err).Fatal("Failed to subscribe")
-		}
-
-		wg.Add(1)
-		f := func() {
-			log.Info("Starting to consume")
-			err := consumeForever(sub, clientChannel, stats)
-			if err != nil {
-				log.WithError(err).Warn("Problem while consuming messages")
-			}
-			log.Info("Finished consuming")
-			wg.Done()
-		}
-
-		funcs = append(funcs, f)
+		log.Fatalf("Failed to start: %v", err)
 	}
 
-	// launch all the tailers
-	for _, f := range funcs {
-		go f()
-	}
-
-	wg.Wait()
-	rootLog.Info("Shutting down")
-}
-
-func consumeForever(sub *nats.Subscription, toSend chan<- *payload, stats *counters) error {
-	for {
-		m, err := sub.NextMsg(time.Hour * 12)
-		if err != nil {
-			if err != nats.ErrTimeout {
-				return err
-			}
-		}
+	app.log.Info("Configured - starting to connect and consume")
 
-		// DO NOT BLOCK
-		// nats is truely a fire and forget, we need to get make sure we are ready to
-		// take off the subject immediately. And we can have tons of go routines so
-		// this seems like the natural pairing.
-		go func() {
-			payload := newPayload(string(m.Data), m.Subject)
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		app.log.WithField("signal", sig).Info("Received shutdown signal")
+		cancel()
+	}()
 
-			// maybe it is json!
-			_ = json.Unmarshal(m.Data, payload)
-
-			toSend <- payload
-		}()
-	}
-}
-
-func reportStats(reportSec int64, stats *counters, log *logrus.Entry) {
-	if reportSec == 0 {
-		log.Debug("Stats reporting disabled")
-		return
+	if err := app.Run(ctx); err != nil {
+		app.log.WithError(err).Warn("Exiting with error")
+		os.Exit(1)
 	}
 
-	ticks := time.Tick(time.Second * time.Duration(reportSec))
-	for range ticks {
-		log.WithFields(logrus.Fields{
-			"messages_rx": stats.natsConsumed,
-			"messages_tx": stats.esSent,
-		}).Info("processed messages from nats to es")
-	}
+	app.log.Info("Shutdown complete")
 }
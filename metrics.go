@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type metricsConfig struct {
+	Addr string `json:"addr"`
+}
+
+// Metrics is the service's Prometheus registry. It replaces the old
+// log-based reportStats and its non-atomic counters field, so every
+// increment below is safe to call concurrently from any goroutine.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	natsReceived  *prometheus.CounterVec
+	esIndexed     *prometheus.CounterVec
+	batchSize     prometheus.Histogram
+	batchDuration prometheus.Histogram
+	bulkRetries   prometheus.Counter
+	natsConnected prometheus.Gauge
+}
+
+// NewMetrics builds and registers all of the service's counters, histograms
+// and gauges on a fresh registry.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		natsReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "elastinats_nats_messages_received_total",
+			Help: "Number of messages received from NATS, by subject.",
+		}, []string{"subject"}),
+		esIndexed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "elastinats_es_documents_indexed_total",
+			Help: "Number of documents sent to Elasticsearch, by index and result.",
+		}, []string{"index", "result"}),
+		batchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "elastinats_batch_size",
+			Help:    "Number of payloads per batch flushed to the output.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+		batchDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "elastinats_batch_duration_seconds",
+			Help:    "Time taken to flush a batch to the output.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		bulkRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "elastinats_es_bulk_indexer_retries_total",
+			Help: "Number of times a document was retried against the bulk indexer.",
+		}),
+		natsConnected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "elastinats_nats_connected",
+			Help: "Whether the NATS connection is currently up (1) or down (0).",
+		}),
+	}
+
+	m.registry.MustRegister(m.natsReceived, m.esIndexed, m.batchSize, m.batchDuration, m.bulkRetries, m.natsConnected)
+
+	return m
+}
+
+func (m *Metrics) NatsMessageReceived(subject string) {
+	m.natsReceived.WithLabelValues(subject).Inc()
+}
+
+func (m *Metrics) ESDocumentIndexed(index, result string) {
+	m.esIndexed.WithLabelValues(index, result).Inc()
+}
+
+func (m *Metrics) ObserveBatch(size int, dur time.Duration) {
+	m.batchSize.Observe(float64(size))
+	m.batchDuration.Observe(dur.Seconds())
+}
+
+func (m *Metrics) BulkIndexerRetried() {
+	m.bulkRetries.Inc()
+}
+
+func (m *Metrics) SetNatsConnected(connected bool) {
+	if connected {
+		m.natsConnected.Set(1)
+		return
+	}
+	m.natsConnected.Set(0)
+}
+
+// Serve starts the /metrics HTTP listener and blocks until it exits.
+func (m *Metrics) Serve(addr string, log *logrus.Entry) error {
+	if addr == "" {
+		addr = ":9100"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+
+	log.WithField("addr", addr).Info("Serving prometheus metrics")
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Output is the sink a batch of payloads is flushed to. Send must not return
+// until the batch has actually been persisted (or definitively failed) --
+// callers use a nil return to advance the wal watermark and ack JetStream
+// messages, so an Output that only enqueues the batch and returns early would
+// make both of those lie. Implementations must be safe to call Send from
+// multiple goroutines concurrently.
+type Output interface {
+	Send(ctx context.Context, batch []*payload) error
+	Close() error
+}
+
+type outputConfig struct {
+	Type    string        `json:"type"`
+	Elastic elasticConfig `json:"elastic"`
+	File    fileConfig    `json:"file"`
+	Kafka   kafkaConfig   `json:"kafka"`
+}
+
+// buildOutput constructs the configured Output. Unless a type is specified it
+// defaults to "elasticsearch" so existing config files keep working.
+func buildOutput(config *outputConfig, metrics *Metrics, log *logrus.Entry) (Output, error) {
+	switch config.Type {
+	case "", "elasticsearch":
+		return newESOutput(&config.Elastic, metrics, log)
+	case "stdout":
+		return newWriterOutput(os.Stdout, log), nil
+	case "file":
+		return newFileOutput(&config.File, log)
+	case "kafka":
+		return newKafkaOutput(&config.Kafka, log)
+	default:
+		return nil, fmt.Errorf("unknown output type '%s'", config.Type)
+	}
+}
+
+type fileConfig struct {
+	Path string `json:"path"`
+}
+
+// writerOutput dumps payloads as newline-delimited JSON to an io.Writer. It
+// backs both the "stdout" and "file" output types and is meant for local
+// debugging, not production durability.
+type writerOutput struct {
+	w   io.Writer
+	log *logrus.Entry
+}
+
+func newWriterOutput(w io.Writer, log *logrus.Entry) *writerOutput {
+	return &writerOutput{w: w, log: log}
+}
+
+func newFileOutput(config *fileConfig, log *logrus.Entry) (*writerOutput, error) {
+	f, err := os.OpenFile(config.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open output file '%s': %v", config.Path, err)
+	}
+	return newWriterOutput(f, log), nil
+}
+
+func (o *writerOutput) Send(_ context.Context, batch []*payload) error {
+	enc := json.NewEncoder(o.w)
+	for _, p := range batch {
+		if err := enc.Encode(p); err != nil {
+			o.log.WithError(err).Warn("Failed to write payload")
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *writerOutput) Close() error {
+	if closer, ok := o.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
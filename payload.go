@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	rawMsgKey    = "@raw_msg"
+	timestampKey = "@timestamp"
+	sourceKey    = "@source"
+
+	// indexKey, if set by a processor (see indexTemplateProcessor), overrides
+	// the Elasticsearch output's statically configured index for this payload.
+	indexKey = "@index"
+)
+
+// payload is a single document on its way from NATS to an Output. msg is the
+// originating JetStream message, carried along so it can be acked once an
+// Output confirms the document is durably persisted; it is nil for core NATS
+// subjects, which
+// have no delivery guarantee to ack.
+type payload struct {
+	fields map[string]interface{}
+	msg    *nats.Msg
+
+	// walSeq is the request number this payload was assigned in the WAL, if
+	// any is enabled. 0 means "not tracked by a WAL".
+	walSeq uint64
+}
+
+func newPayload(msg, source string) *payload {
+	return &payload{
+		fields: map[string]interface{}{
+			rawMsgKey:    msg,
+			sourceKey:    source,
+			timestampKey: time.Now().Format(time.RFC3339),
+		},
+	}
+}
+
+func (p *payload) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.fields)
+}
+
+// UnmarshalJSON merges decoded fields into the existing map, the same
+// opportunistic-JSON behavior the code had back when payload was a bare map.
+func (p *payload) UnmarshalJSON(data []byte) error {
+	if p.fields == nil {
+		p.fields = map[string]interface{}{}
+	}
+	return json.Unmarshal(data, &p.fields)
+}
+
+// indexOverride returns the per-document index name stashed by
+// indexTemplateProcessor, if any, removing it from the fields that get
+// marshaled out to the output.
+func (p *payload) indexOverride() (string, bool) {
+	v, ok := p.fields[indexKey]
+	if !ok {
+		return "", false
+	}
+	delete(p.fields, indexKey)
+
+	name, ok := v.(string)
+	return name, ok
+}
+
+// Ack acknowledges the originating JetStream message, if there is one.
+func (p *payload) Ack() error {
+	if p.msg == nil {
+		return nil
+	}
+	return p.msg.Ack()
+}
+
+// Nak tells JetStream delivery failed permanently so the message can be
+// redelivered or routed to a dead letter subject, if there is one.
+func (p *payload) Nak() error {
+	if p.msg == nil {
+		return nil
+	}
+	return p.msg.Nak()
+}
+
+// InProgress heartbeats a long-running retry so JetStream doesn't consider
+// the message timed out and redeliver it out from under us.
+func (p *payload) InProgress() error {
+	if p.msg == nil {
+		return nil
+	}
+	return p.msg.InProgress()
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Processor transforms a payload as it flows from NATS to the batch channel.
+// Returning a nil payload (with a nil error) drops the payload from the
+// pipeline entirely, e.g. a drop-if-match filter.
+type Processor interface {
+	Process(p *payload) (*payload, error)
+}
+
+type processorConfig struct {
+	Type string `json:"type"`
+
+	// "add_fields"
+	Fields map[string]interface{} `json:"fields"`
+
+	// "drop_fields"
+	DropFields []string `json:"drop_fields"`
+
+	// "rename_field"
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// "split_subject"
+	SubjectFields []string `json:"subject_fields"`
+	Separator     string   `json:"separator"`
+
+	// "drop_if_match"
+	Field   string `json:"field"`
+	Pattern string `json:"pattern"`
+
+	// "grok" (regex extraction with named capture groups)
+	SourceField string `json:"source_field"`
+
+	// "geoip"
+	IPField string `json:"ip_field"`
+	DBPath  string `json:"db_path"`
+
+	// "index_template", e.g. "logs-{app}-{yyyy.MM.dd}"
+	IndexTemplate string `json:"index_template"`
+}
+
+// buildProcessorChain turns the configured processor list into the chain
+// consumeForever/consumeJetStream run each payload through before it's
+// handed to the batch channel.
+func buildProcessorChain(configs []processorConfig) ([]Processor, error) {
+	chain := make([]Processor, 0, len(configs))
+	for _, c := range configs {
+		p, err := buildProcessor(&c)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, p)
+	}
+	return chain, nil
+}
+
+// runProcessors runs p through chain in order, short-circuiting on the first
+// error or on a processor that drops the payload (returns nil, nil).
+func runProcessors(chain []Processor, p *payload) (*payload, error) {
+	for _, proc := range chain {
+		var err error
+		p, err = proc.Process(p)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			return nil, nil
+		}
+	}
+	return p, nil
+}
+
+func buildProcessor(config *processorConfig) (Processor, error) {
+	switch config.Type {
+	case "add_fields":
+		return addFieldsProcessor{fields: config.Fields}, nil
+	case "drop_fields":
+		return dropFieldsProcessor{fields: config.DropFields}, nil
+	case "rename_field":
+		if config.From == "" || config.To == "" {
+			return nil, fmt.Errorf("rename_field processor requires 'from' and 'to'")
+		}
+		return renameFieldProcessor{from: config.From, to: config.To}, nil
+	case "split_subject":
+		if len(config.SubjectFields) == 0 {
+			return nil, fmt.Errorf("split_subject processor requires 'subject_fields'")
+		}
+		sep := config.Separator
+		if sep == "" {
+			sep = "."
+		}
+		return splitSubjectProcessor{fields: config.SubjectFields, separator: sep}, nil
+	case "drop_if_match":
+		re, err := regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid drop_if_match pattern: %v", err)
+		}
+		return dropIfMatchProcessor{field: config.Field, re: re}, nil
+	case "grok":
+		re, err := regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid grok pattern: %v", err)
+		}
+		return grokProcessor{sourceField: config.SourceField, re: re}, nil
+	case "geoip":
+		db, err := geoip2.Open(config.DBPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open geoip database '%s': %v", config.DBPath, err)
+		}
+		return &geoIPProcessor{ipField: config.IPField, db: db}, nil
+	case "index_template":
+		if config.IndexTemplate == "" {
+			return nil, fmt.Errorf("index_template processor requires 'index_template'")
+		}
+		return indexTemplateProcessor{template: config.IndexTemplate}, nil
+	default:
+		return nil, fmt.Errorf("unknown processor type '%s'", config.Type)
+	}
+}
+
+type addFieldsProcessor struct {
+	fields map[string]interface{}
+}
+
+func (a addFieldsProcessor) Process(p *payload) (*payload, error) {
+	for k, v := range a.fields {
+		p.fields[k] = v
+	}
+	return p, nil
+}
+
+type dropFieldsProcessor struct {
+	fields []string
+}
+
+func (d dropFieldsProcessor) Process(p *payload) (*payload, error) {
+	for _, k := range d.fields {
+		delete(p.fields, k)
+	}
+	return p, nil
+}
+
+type renameFieldProcessor struct {
+	from, to string
+}
+
+func (r renameFieldProcessor) Process(p *payload) (*payload, error) {
+	if v, ok := p.fields[r.from]; ok {
+		p.fields[r.to] = v
+		delete(p.fields, r.from)
+	}
+	return p, nil
+}
+
+// splitSubjectProcessor parses the NATS subject into its dot-delimited
+// components, indexing each under the configured field name, e.g. subject
+// "app.service.level" with fields ["app", "service", "level"] adds those
+// three fields to the payload.
+type splitSubjectProcessor struct {
+	fields    []string
+	separator string
+}
+
+func (s splitSubjectProcessor) Process(p *payload) (*payload, error) {
+	source, _ := p.fields[sourceKey].(string)
+	parts := strings.Split(source, s.separator)
+
+	for i, name := range s.fields {
+		if i >= len(parts) {
+			break
+		}
+		p.fields[name] = parts[i]
+	}
+
+	return p, nil
+}
+
+// dropIfMatchProcessor drops the payload entirely when field matches re,
+// e.g. filtering out noisy health-check log lines before they reach ES.
+type dropIfMatchProcessor struct {
+	field string
+	re    *regexp.Regexp
+}
+
+func (d dropIfMatchProcessor) Process(p *payload) (*payload, error) {
+	v, ok := p.fields[d.field].(string)
+	if ok && d.re.MatchString(v) {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// grokProcessor extracts named capture groups from sourceField into fields
+// on the payload, for log lines that aren't JSON to begin with.
+type grokProcessor struct {
+	sourceField string
+	re          *regexp.Regexp
+}
+
+func (g grokProcessor) Process(p *payload) (*payload, error) {
+	v, ok := p.fields[g.sourceField].(string)
+	if !ok {
+		return p, nil
+	}
+
+	match := g.re.FindStringSubmatch(v)
+	if match == nil {
+		return p, nil
+	}
+
+	for i, name := range g.re.SubexpNames() {
+		if i == 0 || name == "" {
+			continue
+		}
+		p.fields[name] = match[i]
+	}
+
+	return p, nil
+}
+
+// geoIPProcessor annotates a payload with geo fields looked up from an IP
+// address stored in ipField.
+type geoIPProcessor struct {
+	ipField string
+	db      *geoip2.Reader
+}
+
+func (g *geoIPProcessor) Process(p *payload) (*payload, error) {
+	raw, ok := p.fields[g.ipField].(string)
+	if !ok {
+		return p, nil
+	}
+
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		return p, nil
+	}
+
+	record, err := g.db.City(ip)
+	if err != nil {
+		return p, nil
+	}
+
+	p.fields["geoip.city_name"] = record.City.Names["en"]
+	p.fields["geoip.country_code"] = record.Country.IsoCode
+	p.fields["geoip.location"] = map[string]float64{
+		"lat": record.Location.Latitude,
+		"lon": record.Location.Longitude,
+	}
+
+	return p, nil
+}
+
+// indexTemplateProcessor renders a dynamic ES index name for the payload,
+// e.g. "logs-{app}-{yyyy.MM.dd}", and stashes it under indexKey for the
+// Elasticsearch output to pick up instead of the static configured index.
+type indexTemplateProcessor struct {
+	template string
+}
+
+func (t indexTemplateProcessor) Process(p *payload) (*payload, error) {
+	now := time.Now().UTC()
+	name := strings.NewReplacer(
+		"{yyyy.MM.dd}", now.Format("2006.01.02"),
+		"{yyyy.MM}", now.Format("2006.01"),
+	).Replace(t.template)
+
+	for k, v := range p.fields {
+		placeholder := "{" + k + "}"
+		if strings.Contains(name, placeholder) {
+			name = strings.ReplaceAll(name, placeholder, fmt.Sprintf("%v", v))
+		}
+	}
+
+	p.fields[indexKey] = name
+	return p, nil
+}
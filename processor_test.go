@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func newTestPayload(fields map[string]interface{}) *payload {
+	p := newPayload("raw", "test.subject")
+	for k, v := range fields {
+		p.fields[k] = v
+	}
+	return p
+}
+
+func TestAddFieldsProcessor(t *testing.T) {
+	p := newTestPayload(nil)
+	proc := addFieldsProcessor{fields: map[string]interface{}{"env": "prod"}}
+
+	out, err := proc.Process(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.fields["env"] != "prod" {
+		t.Fatalf("expected env=prod, got %v", out.fields["env"])
+	}
+}
+
+func TestDropFieldsProcessor(t *testing.T) {
+	p := newTestPayload(map[string]interface{}{"secret": "shh", "keep": "me"})
+	proc := dropFieldsProcessor{fields: []string{"secret"}}
+
+	out, err := proc.Process(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.fields["secret"]; ok {
+		t.Fatal("expected 'secret' to be dropped")
+	}
+	if out.fields["keep"] != "me" {
+		t.Fatalf("expected 'keep' to survive, got %v", out.fields["keep"])
+	}
+}
+
+func TestRenameFieldProcessor(t *testing.T) {
+	p := newTestPayload(map[string]interface{}{"old": "value"})
+	proc := renameFieldProcessor{from: "old", to: "new"}
+
+	out, err := proc.Process(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.fields["old"]; ok {
+		t.Fatal("expected 'old' to be removed")
+	}
+	if out.fields["new"] != "value" {
+		t.Fatalf("expected new=value, got %v", out.fields["new"])
+	}
+}
+
+func TestRenameFieldProcessorMissingField(t *testing.T) {
+	p := newTestPayload(nil)
+	proc := renameFieldProcessor{from: "old", to: "new"}
+
+	out, err := proc.Process(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.fields["new"]; ok {
+		t.Fatal("expected no 'new' field when 'old' was never set")
+	}
+}
+
+func TestSplitSubjectProcessor(t *testing.T) {
+	p := newPayload("raw", "app.service.level")
+	proc := splitSubjectProcessor{fields: []string{"app", "service", "level"}, separator: "."}
+
+	out, err := proc.Process(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.fields["app"] != "app" || out.fields["service"] != "service" || out.fields["level"] != "level" {
+		t.Fatalf("unexpected fields: %+v", out.fields)
+	}
+}
+
+func TestSplitSubjectProcessorFewerPartsThanFields(t *testing.T) {
+	p := newPayload("raw", "app.service")
+	proc := splitSubjectProcessor{fields: []string{"app", "service", "level"}, separator: "."}
+
+	out, err := proc.Process(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.fields["level"]; ok {
+		t.Fatal("expected no 'level' field when the subject has fewer parts")
+	}
+}
+
+func TestDropIfMatchProcessor(t *testing.T) {
+	re := regexp.MustCompile(`^healthcheck`)
+	proc := dropIfMatchProcessor{field: "msg", re: re}
+
+	dropped, err := proc.Process(newTestPayload(map[string]interface{}{"msg": "healthcheck ok"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dropped != nil {
+		t.Fatal("expected matching payload to be dropped")
+	}
+
+	kept, err := proc.Process(newTestPayload(map[string]interface{}{"msg": "something else"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if kept == nil {
+		t.Fatal("expected non-matching payload to survive")
+	}
+}
+
+func TestGrokProcessor(t *testing.T) {
+	re := regexp.MustCompile(`^(?P<level>\w+): (?P<msg>.*)$`)
+	proc := grokProcessor{sourceField: "raw_line", re: re}
+
+	p := newTestPayload(map[string]interface{}{"raw_line": "WARN: disk almost full"})
+	out, err := proc.Process(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.fields["level"] != "WARN" || out.fields["msg"] != "disk almost full" {
+		t.Fatalf("unexpected fields: %+v", out.fields)
+	}
+}
+
+func TestGrokProcessorNoMatch(t *testing.T) {
+	re := regexp.MustCompile(`^(?P<level>\w+): (?P<msg>.*)$`)
+	proc := grokProcessor{sourceField: "raw_line", re: re}
+
+	p := newTestPayload(map[string]interface{}{"raw_line": "not a match"})
+	out, err := proc.Process(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.fields["level"]; ok {
+		t.Fatal("expected no fields to be extracted on a non-match")
+	}
+}
+
+func TestIndexTemplateProcessor(t *testing.T) {
+	p := newTestPayload(map[string]interface{}{"app": "billing"})
+	proc := indexTemplateProcessor{template: "logs-{app}"}
+
+	out, err := proc.Process(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	name, ok := out.indexOverride()
+	if !ok {
+		t.Fatal("expected indexOverride to report the templated index")
+	}
+	if name != "logs-billing" {
+		t.Fatalf("expected 'logs-billing', got %q", name)
+	}
+}
+
+type stubProcessor struct {
+	out *payload
+	err error
+}
+
+func (s stubProcessor) Process(_ *payload) (*payload, error) {
+	return s.out, s.err
+}
+
+func TestRunProcessorsStopsOnDrop(t *testing.T) {
+	never := addFieldsProcessor{fields: map[string]interface{}{"should_not_run": true}}
+	chain := []Processor{stubProcessor{out: nil, err: nil}, never}
+
+	out, err := runProcessors(chain, newTestPayload(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != nil {
+		t.Fatal("expected a dropped payload to stay nil")
+	}
+}
+
+func TestRunProcessorsStopsOnError(t *testing.T) {
+	boom := errors.New("boom")
+	never := addFieldsProcessor{fields: map[string]interface{}{"should_not_run": true}}
+	chain := []Processor{stubProcessor{out: nil, err: boom}, never}
+
+	_, err := runProcessors(chain, newTestPayload(nil))
+	if err != boom {
+		t.Fatalf("expected the chain's error to propagate, got %v", err)
+	}
+}
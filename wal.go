@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+type walConfig struct {
+	Enabled      bool   `json:"enabled"`
+	Dir          string `json:"dir"`
+	SegmentSize  int64  `json:"segment_size"`
+	MaxDiskBytes int64  `json:"max_disk_bytes"`
+}
+
+const walWatermarkFile = "watermark"
+
+// WAL is a segmented, disk-backed write-ahead log sitting between the NATS
+// consumer and the configured Output. Every payload is appended here before
+// it's offered to the batch channel; once an Output confirms a batch was
+// persisted, the watermark advances past it. Replay, which Run calls once at
+// startup, re-feeds everything appended since the last committed watermark,
+// so records that were never confirmed -- because the process died or the
+// Output was down -- are sent again on the next start instead of lost. A
+// running process does not replay them while the Output is down.
+type WAL struct {
+	mu sync.Mutex
+
+	dir          string
+	segmentSize  int64
+	maxDiskBytes int64
+
+	nextReqNum uint64
+	committed  uint64
+
+	curSegment     *os.File
+	curSegmentSize int64
+
+	log *logrus.Entry
+}
+
+func newWAL(config *walConfig, log *logrus.Entry) (*WAL, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create wal dir '%s': %v", config.Dir, err)
+	}
+
+	w := &WAL{
+		dir:          config.Dir,
+		segmentSize:  config.SegmentSize,
+		maxDiskBytes: config.MaxDiskBytes,
+		log:          log.WithField("component", "wal"),
+	}
+
+	committed, err := w.readWatermark()
+	if err != nil {
+		return nil, err
+	}
+	w.committed = committed
+
+	// Resuming numbering from committed+1 isn't enough on its own: records
+	// past the watermark can already be on disk (appended but not yet
+	// confirmed persisted when the process stopped), and reusing their
+	// reqNums here would duplicate them instead of continuing after them.
+	maxOnDisk, err := w.maxReqNumOnDisk()
+	if err != nil {
+		return nil, err
+	}
+	w.nextReqNum = committed + 1
+	if maxOnDisk >= w.nextReqNum {
+		w.nextReqNum = maxOnDisk + 1
+	}
+
+	if err := w.openForAppend(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *WAL) watermarkPath() string {
+	return filepath.Join(w.dir, walWatermarkFile)
+}
+
+func (w *WAL) readWatermark() (uint64, error) {
+	raw, err := ioutil.ReadFile(w.watermarkPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read wal watermark: %v", err)
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("corrupt wal watermark: %v", err)
+	}
+	return n, nil
+}
+
+// maxReqNumOnDisk scans every segment for the highest request number already
+// written, so newWAL can resume numbering after it instead of colliding with
+// records that were appended but never got the chance to commit.
+func (w *WAL) maxReqNumOnDisk() (uint64, error) {
+	segments, err := w.segmentPaths()
+	if err != nil {
+		return 0, err
+	}
+
+	var max uint64
+	for _, path := range segments {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+
+		r := bufio.NewReader(f)
+		for {
+			header := make([]byte, 12)
+			if _, err := io.ReadFull(r, header); err != nil {
+				break
+			}
+
+			reqNum := binary.BigEndian.Uint64(header[0:8])
+			length := binary.BigEndian.Uint32(header[8:12])
+			if reqNum > max {
+				max = reqNum
+			}
+
+			if _, err := r.Discard(int(length)); err != nil {
+				f.Close()
+				return 0, err
+			}
+		}
+		f.Close()
+	}
+
+	return max, nil
+}
+
+// segmentPaths returns every segment file under dir, oldest first.
+func (w *WAL) segmentPaths() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(w.dir, "segment-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func (w *WAL) openForAppend() error {
+	segments, err := w.segmentPaths()
+	if err != nil {
+		return err
+	}
+
+	var path string
+	if len(segments) == 0 {
+		path = filepath.Join(w.dir, fmt.Sprintf("segment-%020d.log", w.nextReqNum))
+	} else {
+		path = segments[len(segments)-1]
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open wal segment '%s': %v", path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.curSegment = f
+	w.curSegmentSize = info.Size()
+	return nil
+}
+
+// rotationThreshold is the segment size Append rotates on. It's normally
+// just segmentSize, but a max_disk_bytes cap with no segment_size set would
+// otherwise never rotate at all -- there'd be one ever-growing segment and
+// enforceDiskLimit (only ever called from rotate) would have no old segments
+// to drop, silently defeating the cap. Falling back to maxDiskBytes itself
+// keeps that combination meaningful.
+func (w *WAL) rotationThreshold() int64 {
+	if w.segmentSize > 0 {
+		return w.segmentSize
+	}
+	return w.maxDiskBytes
+}
+
+func (w *WAL) rotate() error {
+	if err := w.curSegment.Close(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(w.dir, fmt.Sprintf("segment-%020d.log", w.nextReqNum))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create wal segment '%s': %v", path, err)
+	}
+
+	w.curSegment = f
+	w.curSegmentSize = 0
+	return w.enforceDiskLimit()
+}
+
+// enforceDiskLimit drops the oldest segments once the WAL's on-disk size
+// exceeds maxDiskBytes. It never drops the segment currently being written.
+func (w *WAL) enforceDiskLimit() error {
+	if w.maxDiskBytes <= 0 {
+		return nil
+	}
+
+	segments, err := w.segmentPaths()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	sizes := make([]int64, len(segments))
+	for i, s := range segments {
+		info, err := os.Stat(s)
+		if err != nil {
+			continue
+		}
+		sizes[i] = info.Size()
+		total += info.Size()
+	}
+
+	for i := 0; i < len(segments)-1 && total > w.maxDiskBytes; i++ {
+		w.log.WithField("segment", segments[i]).Warn("Dropping oldest wal segment, over max_disk_bytes")
+		if err := os.Remove(segments[i]); err != nil {
+			return err
+		}
+		total -= sizes[i]
+	}
+
+	return nil
+}
+
+// record is a single length-prefixed entry: [8-byte request number][4-byte
+// length][json body].
+func (w *WAL) appendRecord(reqNum uint64, body []byte) error {
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint64(header[0:8], reqNum)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(body)))
+
+	if _, err := w.curSegment.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.curSegment.Write(body); err != nil {
+		return err
+	}
+
+	w.curSegmentSize += int64(len(header) + len(body))
+	return nil
+}
+
+// Append assigns the next monotonic request number to p, durably writes it,
+// and returns that number so the caller can later Commit it.
+func (w *WAL) Append(p *payload) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal payload for wal: %v", err)
+	}
+
+	reqNum := w.nextReqNum
+
+	if limit := w.rotationThreshold(); limit > 0 && w.curSegmentSize+int64(len(body)+12) > limit {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := w.appendRecord(reqNum, body); err != nil {
+		return 0, err
+	}
+
+	w.nextReqNum = reqNum + 1
+	return reqNum, nil
+}
+
+// Commit advances the watermark past reqNum once the batch containing it has
+// been durably persisted downstream.
+func (w *WAL) Commit(reqNum uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if reqNum <= w.committed {
+		return nil
+	}
+	w.committed = reqNum
+
+	tmp := w.watermarkPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(reqNum, 10)), 0644); err != nil {
+		return fmt.Errorf("failed to write wal watermark: %v", err)
+	}
+	return os.Rename(tmp, w.watermarkPath())
+}
+
+// Replay reads every record after the last committed watermark and hands it
+// to fn, in request-number order. It's meant to be called once at startup to
+// recover anything buffered during a crash or a long output outage.
+func (w *WAL) Replay(fn func(*payload) error) error {
+	segments, err := w.segmentPaths()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range segments {
+		if err := w.replaySegment(path, fn); err != nil {
+			return fmt.Errorf("failed to replay wal segment '%s': %v", path, err)
+		}
+	}
+	return nil
+}
+
+func (w *WAL) replaySegment(path string, fn func(*payload) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		header := make([]byte, 12)
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		reqNum := binary.BigEndian.Uint64(header[0:8])
+		length := binary.BigEndian.Uint32(header[8:12])
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+
+		if reqNum <= w.committed {
+			continue
+		}
+
+		p := &payload{}
+		if err := json.Unmarshal(body, p); err != nil {
+			w.log.WithError(err).Warn("Skipping corrupt wal record")
+			continue
+		}
+		p.walSeq = reqNum
+
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+}
+
+// appendToWAL appends p to wal and stamps it with the assigned request
+// number, if wal is enabled. It's a no-op when wal is nil.
+func appendToWAL(wal *WAL, p *payload) error {
+	if wal == nil {
+		return nil
+	}
+
+	seq, err := wal.Append(p)
+	if err != nil {
+		return err
+	}
+	p.walSeq = seq
+	return nil
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.curSegment.Close()
+}
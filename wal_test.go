@@ -0,0 +1,170 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func newTestWAL(t *testing.T, config *walConfig) *WAL {
+	t.Helper()
+	config.Dir = t.TempDir()
+
+	w, err := newWAL(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatalf("newWAL: %v", err)
+	}
+	t.Cleanup(func() { _ = w.Close() })
+	return w
+}
+
+func TestWALAppendAssignsMonotonicReqNums(t *testing.T) {
+	w := newTestWAL(t, &walConfig{})
+
+	first, err := w.Append(newPayload("one", "test.subject"))
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	second, err := w.Append(newPayload("two", "test.subject"))
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	if first != 1 || second != 2 {
+		t.Fatalf("expected reqNums 1, 2, got %d, %d", first, second)
+	}
+}
+
+func TestWALCommitIsIdempotentAndMonotonic(t *testing.T) {
+	w := newTestWAL(t, &walConfig{})
+
+	if _, err := w.Append(newPayload("one", "test.subject")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if _, err := w.Append(newPayload("two", "test.subject")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	if err := w.Commit(2); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	// Committing the same reqNum again must be a no-op.
+	if err := w.Commit(2); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	// Committing an older reqNum after a newer one must not move the
+	// watermark backwards.
+	if err := w.Commit(1); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	committed, err := w.readWatermark()
+	if err != nil {
+		t.Fatalf("readWatermark: %v", err)
+	}
+	if committed != 2 {
+		t.Fatalf("expected committed watermark 2, got %d", committed)
+	}
+}
+
+func TestWALReplaySkipsCommittedRecords(t *testing.T) {
+	w := newTestWAL(t, &walConfig{})
+
+	if _, err := w.Append(newPayload("one", "test.subject")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if _, err := w.Append(newPayload("two", "test.subject")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if _, err := w.Append(newPayload("three", "test.subject")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	if err := w.Commit(1); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	var replayed []uint64
+	err := w.Replay(func(p *payload) error {
+		replayed = append(replayed, p.walSeq)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	if len(replayed) != 2 || replayed[0] != 2 || replayed[1] != 3 {
+		t.Fatalf("expected replay to yield reqNums [2 3], got %v", replayed)
+	}
+}
+
+func TestWALReplayAfterReopenResumesFromWatermark(t *testing.T) {
+	dir := t.TempDir()
+	config := &walConfig{Dir: dir}
+
+	w, err := newWAL(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatalf("newWAL: %v", err)
+	}
+	if _, err := w.Append(newPayload("one", "test.subject")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if _, err := w.Append(newPayload("two", "test.subject")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := w.Commit(1); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened, err := newWAL(config, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatalf("newWAL (reopen): %v", err)
+	}
+	defer reopened.Close()
+
+	var replayed []uint64
+	err = reopened.Replay(func(p *payload) error {
+		replayed = append(replayed, p.walSeq)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	if len(replayed) != 1 || replayed[0] != 2 {
+		t.Fatalf("expected replay to resume at reqNum 2, got %v", replayed)
+	}
+
+	next, err := reopened.Append(newPayload("three", "test.subject"))
+	if err != nil {
+		t.Fatalf("Append after reopen: %v", err)
+	}
+	if next != 3 {
+		t.Fatalf("expected next reqNum 3 after reopen, got %d", next)
+	}
+}
+
+func TestWALRotationThresholdFallsBackToMaxDiskBytes(t *testing.T) {
+	cases := []struct {
+		name         string
+		segmentSize  int64
+		maxDiskBytes int64
+		want         int64
+	}{
+		{"segment_size set", 100, 50, 100},
+		{"segment_size unset, max_disk_bytes set", 0, 50, 50},
+		{"neither set", 0, 0, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := &WAL{segmentSize: c.segmentSize, maxDiskBytes: c.maxDiskBytes}
+			if got := w.rotationThreshold(); got != c.want {
+				t.Fatalf("rotationThreshold() = %d, want %d", got, c.want)
+			}
+		})
+	}
+}